@@ -1,18 +1,30 @@
 package pcap_broker
 
 import (
+	"bufio"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/shlex"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/pcapgo"
 
@@ -20,20 +32,249 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// clientFilterPreamble is how long we wait for a client to send its optional
+// "FILTER <bpf expression>\n" line before giving up and streaming unfiltered.
+const clientFilterPreamble = 200 * time.Millisecond
+
+// packetWriter is implemented by both pcapgo.Writer (legacy, single-link
+// pcap) and pcapgo.NgWriter (pcapng, one Interface Description Block per
+// source), so a client's writer can be either depending on -legacy-pcap.
+type packetWriter interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+}
+
+// flusher is implemented by writers that buffer internally (pcapgo.NgWriter)
+// and need an explicit flush for packets to actually reach the client.
+type flusher interface {
+	Flush() error
+}
+
+// PcapClient is one connected PCAP-over-IP client. Packets are handed to it
+// by processPackets through queue, a bounded ring buffer drained by its own
+// goroutine (serveClient), so one slow client can no longer stall delivery
+// to the others or back up the capture pipeline. All counters are updated
+// with atomic operations since the metrics HTTP handler reads them from a
+// different goroutine than serveClient/processPackets.
 type PcapClient struct {
-	writer       *pcapgo.Writer
-	totalPackets uint64
-	totalBytes   uint64
+	conn   net.Conn
+	writer packetWriter
+	bpfs   map[int]*pcap.BPF
+
+	queue          chan packetEnvelope
+	maxBufferBytes int
+	queuedBytes    int64
+	closed         int32
+
+	totalPackets   uint64
+	totalBytes     uint64
+	droppedPackets uint64
 }
 
+// enqueue hands a packet to the client's buffer. It never blocks: on
+// overflow (either the packet-count or byte-size bound from
+// -client-buffer-packets/-client-buffer-bytes is hit) it applies
+// -slow-client-policy, either dropping the oldest queued packet to make room
+// or disconnecting the client outright. enqueue is only ever called from the
+// single processPackets goroutine, so it's the only writer of queue/closed.
+func (c *PcapClient) enqueue(env packetEnvelope) {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return
+	}
+
+	for len(c.queue) >= cap(c.queue) || atomic.LoadInt64(&c.queuedBytes)+int64(len(env.data)) > int64(c.maxBufferBytes) {
+		if *slowClientPolicy == slowClientPolicyDisconnect {
+			atomic.StoreInt32(&c.closed, 1)
+			log.Warn().Str("remote", c.conn.RemoteAddr().String()).Msg("disconnecting slow client: buffer exceeded")
+			close(c.queue)
+			return
+		}
+
+		select {
+		case old := <-c.queue:
+			atomic.AddInt64(&c.queuedBytes, -int64(len(old.data)))
+			atomic.AddUint64(&c.droppedPackets, 1)
+		default:
+			// nothing queued yet but the byte bound alone rejects this packet
+			atomic.AddUint64(&c.droppedPackets, 1)
+			log.Warn().Str("remote", c.conn.RemoteAddr().String()).Msg("dropping packet for slow client: buffer exceeded")
+			return
+		}
+	}
+
+	c.queue <- env
+	atomic.AddInt64(&c.queuedBytes, int64(len(env.data)))
+}
+
+// clientRegistry is the synchronized replacement for the old bare
+// map[net.Conn]PcapClient: Accept (add/remove) and processPackets (snapshot)
+// used to touch that map from different goroutines with no locking at all.
+type clientRegistry struct {
+	mu      sync.RWMutex
+	clients map[net.Conn]*PcapClient
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{clients: map[net.Conn]*PcapClient{}}
+}
+
+func (r *clientRegistry) add(client *PcapClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clients[client.conn] = client
+}
+
+func (r *clientRegistry) remove(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, conn)
+}
+
+func (r *clientRegistry) snapshot() []*PcapClient {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := make([]*PcapClient, 0, len(r.clients))
+	for _, client := range r.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// tokenStore holds the tokens accepted by -auth-token-file, each mapped to
+// the label it should be logged as, and can be reloaded in place on SIGHUP
+// without dropping already-authenticated clients.
+type tokenStore struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+func newTokenStore() *tokenStore {
+	return &tokenStore{tokens: map[string]string{}}
+}
+
+// load (re)reads path, a file of "<token> <label>" lines (label defaults to
+// the token itself when omitted), replacing the store's contents atomically.
+func (s *tokenStore) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tokens := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		token := fields[0]
+		label := token
+		if len(fields) == 2 {
+			label = strings.TrimSpace(fields[1])
+		}
+		tokens[token] = label
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.tokens = tokens
+	s.mu.Unlock()
+	return nil
+}
+
+// authenticate reports whether token matches one of the loaded tokens,
+// comparing against all of them with subtle.ConstantTimeCompare so lookup
+// time doesn't leak which prefix of a guess was correct, and returns its
+// label on success.
+func (s *tokenStore) authenticate(token string) (label string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for t, l := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return l, true
+		}
+	}
+	return "", false
+}
+
+// source is one producer of packets, either a -cmd subprocess or a -live
+// interface captured in-process. Each source gets its own Interface
+// Description Block in the pcapng stream written to clients. packets accepts
+// any gopacket.ZeroCopyPacketDataSource so both capture modes share the same
+// fan-out path in feedSource.
+type source struct {
+	name        string
+	description string
+	linkType    layers.LinkType
+	packets     gopacket.ZeroCopyPacketDataSource
+}
+
+// packetEnvelope carries a single packet read from one of the sources,
+// tagged with the source's interface index so it lands on the right
+// Interface Description Block of each client's pcapng stream.
+type packetEnvelope struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// cmdFlags collects repeated -cmd flags into a slice.
+type cmdFlags []string
+
+func (c *cmdFlags) String() string {
+	return strings.Join(*c, ", ")
+}
+
+func (c *cmdFlags) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+// slow-client-policy values for -slow-client-policy.
+const (
+	slowClientPolicyDropOldest = "drop-oldest"
+	slowClientPolicyDisconnect = "disconnect"
+)
+
 var (
-	pcapCommand     = flag.String("cmd", "", "command to execute for pcap data (eg: tcpdump -i eth0 -n --immediate-mode -s 65535 -U -w -)")
-	listenAddress   = flag.String("listen", "", "listen address for pcap-over-ip (eg: localhost:4242)")
-	noReverseLookup = flag.Bool("n", false, "disable reverse lookup of connecting PCAP-over-IP client IP address")
-	debug           = flag.Bool("debug", false, "enable debug logging")
-	json            = flag.Bool("json", false, "enable json logging")
+	pcapCommands        cmdFlags
+	connectTargets      cmdFlags
+	liveInterfaces      = flag.String("live", "", "comma separated list of interfaces to capture from directly, bypassing -cmd (eg: eth0,eth1)")
+	liveSnapLen         = flag.Int("snaplen", 65535, "snapshot length for -live interfaces")
+	livePromisc         = flag.Bool("promisc", true, "capture in promiscuous mode for -live interfaces")
+	liveImmediate       = flag.Bool("immediate", true, "enable immediate mode for -live interfaces, delivering packets as soon as they arrive")
+	liveBPF             = flag.String("bpf", "", "BPF filter expression applied at the kernel to -live interfaces")
+	liveTimeout         = flag.Duration("timeout", pcap.BlockForever, "read timeout for -live interfaces, ignored when -immediate is set")
+	listInterfaces      = flag.Bool("list-interfaces", false, "list available capture interfaces (name, description, addresses) and exit")
+	listenAddress       = flag.String("listen", "", "listen address for pcap-over-ip (eg: localhost:4242)")
+	noReverseLookup     = flag.Bool("n", false, "disable reverse lookup of connecting PCAP-over-IP client IP address")
+	noClientFilter      = flag.Bool("no-client-filter", false, "disable per-client BPF filter negotiation (FILTER preamble)")
+	legacyPcap          = flag.Bool("legacy-pcap", false, "write legacy single-link pcap instead of pcapng (requires exactly one source)")
+	clientBufferPackets = flag.Int("client-buffer-packets", 1024, "maximum number of packets buffered per client before -slow-client-policy kicks in")
+	clientBufferBytes   = flag.Int("client-buffer-bytes", 64*1024*1024, "maximum number of bytes buffered per client before -slow-client-policy kicks in")
+	slowClientPolicy    = flag.String("slow-client-policy", slowClientPolicyDropOldest, "what to do when a client's buffer overflows: drop-oldest (default) or disconnect")
+	metricsListen       = flag.String("metrics-listen", "", "listen address to serve per-client packet/byte/drop counters on (eg: localhost:9242), disabled if empty")
+	tlsCertFile         = flag.String("tls-cert", "", "TLS certificate file to serve PCAP-over-IP over TLS instead of plain TCP, requires -tls-key")
+	tlsKeyFile          = flag.String("tls-key", "", "TLS private key file, requires -tls-cert")
+	tlsClientCA         = flag.String("tls-client-ca", "", "CA certificate file to require and verify client certificates against (mTLS), requires -tls-cert")
+	authTokenFile       = flag.String("auth-token-file", "", "file of \"<token> <label>\" lines clients must present via an AUTH preamble before the pcap header is written, reloaded on SIGHUP")
+	connectTLS          = flag.Bool("connect-tls", false, "use TLS when dialing -connect targets")
+	reconnectBackoff    = flag.Duration("reconnect-backoff", time.Second, "initial backoff between -connect reconnect attempts, doubled after each failure up to -reconnect-max")
+	reconnectMax        = flag.Duration("reconnect-max", 30*time.Second, "maximum backoff between -connect reconnect attempts")
+	debug               = flag.Bool("debug", false, "enable debug logging")
+	json                = flag.Bool("json", false, "enable json logging")
 )
 
+func init() {
+	flag.Var(&pcapCommands, "cmd", "command to execute for pcap data, may be given multiple times; falls back to in-process -live capture when unset (eg: tcpdump -i eth0 -n --immediate-mode -s 65535 -U -w -)")
+	flag.Var(&connectTargets, "connect", "address to push pcap-over-ip to as an outbound connection instead of waiting for one, may be given multiple times (eg: collector.example.com:4242)")
+}
+
 func Main() {
 	flag.Parse()
 
@@ -50,10 +291,22 @@ func Main() {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	}
 
-	if *pcapCommand == "" {
-		*pcapCommand = os.Getenv("PCAP_COMMAND")
-		if *pcapCommand == "" {
-			log.Fatal().Msg("PCAP_COMMAND or -cmd not set, see --help for usage")
+	if *listInterfaces {
+		printInterfaces()
+		return
+	}
+
+	if *slowClientPolicy != slowClientPolicyDropOldest && *slowClientPolicy != slowClientPolicyDisconnect {
+		log.Fatal().Str("slow-client-policy", *slowClientPolicy).Msg("invalid -slow-client-policy, must be drop-oldest or disconnect")
+	}
+
+	liveIfaces := splitInterfaces(*liveInterfaces)
+
+	if len(pcapCommands) == 0 && len(liveIfaces) == 0 {
+		if envCmd := os.Getenv("PCAP_COMMAND"); envCmd != "" {
+			pcapCommands = cmdFlags{envCmd}
+		} else {
+			log.Fatal().Msg("PCAP_COMMAND, -cmd or -live not set, see --help for usage")
 		}
 	}
 
@@ -64,60 +317,86 @@ func Main() {
 		}
 	}
 
-	log.Debug().Str("pcapCommand", *pcapCommand).Send()
+	log.Debug().Strs("pcapCommands", pcapCommands).Send()
+	log.Debug().Strs("liveInterfaces", liveIfaces).Send()
 	log.Debug().Str("listenAddress", *listenAddress).Send()
 
-	ctx, cancelFunc := signal.NotifyContext(context.Background(), os.Interrupt)
-
-	// Create connections to PcapClient map
-	connMap := map[net.Conn]PcapClient{}
-
-	// Create a pipe for the command to write to, will be read by pcap.OpenOfflineFile
-	rStdout, wStdout, err := os.Pipe()
+	tlsConfig, err := buildTLSConfig()
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to create pipe")
+		log.Fatal().Err(err).Msg("failed to configure TLS")
 	}
 
-	// Acquire pcap data
-	args, err := shlex.Split(*pcapCommand)
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to parse PCAP_COMMAND")
+	var tokens *tokenStore
+	if *authTokenFile != "" {
+		tokens = newTokenStore()
+		if err := tokens.load(*authTokenFile); err != nil {
+			log.Fatal().Err(err).Str("file", *authTokenFile).Msg("failed to load -auth-token-file")
+		}
+
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		go func() {
+			for range sighup {
+				if err := tokens.load(*authTokenFile); err != nil {
+					log.Err(err).Str("file", *authTokenFile).Msg("failed to reload -auth-token-file")
+				} else {
+					log.Info().Str("file", *authTokenFile).Msg("reloaded -auth-token-file")
+				}
+			}
+		}()
 	}
-	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
-	log.Debug().Strs("args", args).Send()
 
-	cmd.Stdout = wStdout
-	cmd.Stderr = log.Logger.Hook(zerolog.HookFunc(func(e *zerolog.Event, level zerolog.Level, msg string) {
-		e.Str(zerolog.LevelFieldName, zerolog.LevelTraceValue)
-	}))
+	ctx, cancelFunc := signal.NotifyContext(context.Background(), os.Interrupt)
 
-	err = cmd.Start()
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to start command")
+	clients := newClientRegistry()
+
+	if *metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler(clients))
+		go func() {
+			if err := http.ListenAndServe(*metricsListen, mux); err != nil {
+				log.Err(err).Msg("metrics server exited")
+			}
+		}()
+		log.Info().Msgf("serving client metrics on %v/metrics", *metricsListen)
 	}
 
-	log.Debug().Int("pid", cmd.Process.Pid).Msg("started process")
+	sources := make([]*source, 0, len(pcapCommands)+len(liveIfaces))
 
-	// close context on process exit
-	go func() {
-		err := cmd.Wait()
+	for i, commandLine := range pcapCommands {
+		src, err := startCommandSource(ctx, cancelFunc, commandLine, i)
 		if err != nil {
-			log.Fatal().Err(err).Msg("command exited with error")
+			log.Fatal().Err(err).Str("cmd", commandLine).Msg("failed to start capture command")
 		}
-		cancelFunc()
-	}()
+		sources = append(sources, src)
+	}
 
-	// Read from process stdout pipe
-	handle, err := pcap.OpenOfflineFile(rStdout)
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to open pcap file")
+	for _, iface := range liveIfaces {
+		src, err := openLiveSource(iface)
+		if err != nil {
+			log.Fatal().Err(err).Str("iface", iface).Msg("failed to open live interface")
+		}
+		sources = append(sources, src)
+	}
+
+	if *legacyPcap && len(sources) != 1 {
+		log.Fatal().Msg("-legacy-pcap requires exactly one capture source (one -cmd, or one -live interface)")
+	}
+
+	packets := make(chan packetEnvelope, 1024)
+	for i, src := range sources {
+		go feedSource(ctx, i, src, packets)
 	}
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	packetSource.Lazy = true
-	packetSource.NoCopy = true
+	go processPackets(ctx, packets, clients)
 
-	go processPackets(ctx, packetSource, connMap)
+	for _, target := range connectTargets {
+		var dialTLSConfig *tls.Config
+		if *connectTLS {
+			dialTLSConfig = &tls.Config{}
+		}
+		go runDialer(ctx, target, dialTLSConfig, sources, clients)
+	}
 
 	log.Info().Msgf("PCAP-over-IP server listening on %v. press CTRL-C to exit", *listenAddress)
 
@@ -126,6 +405,9 @@ func Main() {
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to listen")
 	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
 
 	// close listener on context cancel
 	go func() {
@@ -145,24 +427,86 @@ func Main() {
 			break
 		}
 
+		var remote string
 		if *noReverseLookup {
-			log.Info().Msgf("PCAP-over-IP connection from %v", conn.RemoteAddr())
+			remote = conn.RemoteAddr().String()
 		} else {
-			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
-			defer cancel()
+			lookupCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 			ipAddr := conn.RemoteAddr().(*net.TCPAddr).IP.String()
-			names, _ := net.DefaultResolver.LookupAddr(ctx, ipAddr)
+			names, _ := net.DefaultResolver.LookupAddr(lookupCtx, ipAddr)
+			cancel()
 			if len(names) == 0 {
-				log.Info().Msgf("PCAP-over-IP connection from %v", conn.RemoteAddr())
+				remote = conn.RemoteAddr().String()
 			} else {
-				log.Info().Msgf("PCAP-over-IP connection from %v (%v)", conn.RemoteAddr(), names[0])
+				remote = fmt.Sprintf("%v (%v)", conn.RemoteAddr(), names[0])
 			}
 		}
 
-		writer := pcapgo.NewWriter(conn)
+		var identity string
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			if err := tlsConn.Handshake(); err != nil {
+				log.Err(err).Str("remote", remote).Msg("TLS handshake failed")
+				conn.Close()
+				continue
+			}
+			if peerCerts := tlsConn.ConnectionState().PeerCertificates; len(peerCerts) > 0 {
+				identity = peerCerts[0].Subject.CommonName
+			}
+		}
+
+		// Shared across both preambles below so a client that pipelines
+		// "AUTH ...\nFILTER ...\n" in one write can't have its FILTER line
+		// silently swallowed: a fresh bufio.Reader per preamble could slurp
+		// both lines off the socket in one read, consume only the one it
+		// was looking for, and discard the rest along with it.
+		connReader := bufio.NewReader(conn)
+
+		if tokens != nil {
+			label, err := authenticateToken(conn, connReader, tokens)
+			if err != nil {
+				log.Warn().Err(err).Str("remote", remote).Msg("client failed token authentication")
+				conn.Close()
+				continue
+			}
+			identity = label
+		}
 
-		// Write pcap header
-		err = writer.WriteFileHeader(65535, handle.LinkType())
+		if identity != "" {
+			log.Info().Str("remote", remote).Str("identity", identity).Msg("PCAP-over-IP connection authenticated")
+		} else {
+			log.Info().Msgf("PCAP-over-IP connection from %v", remote)
+		}
+
+		var bpfs map[int]*pcap.BPF
+		if !*noClientFilter {
+			var expr string
+			expr, err = readClientFilter(conn, connReader)
+			if err != nil {
+				log.Err(err).Msg("failed to negotiate client BPF filter")
+				err := conn.Close()
+				if err != nil {
+					log.Err(err).Msg("failed to close connection")
+				}
+
+				continue
+			}
+
+			if expr != "" {
+				bpfs, err = compileClientFilter(expr, sources)
+				if err != nil {
+					log.Err(err).Str("filter", expr).Msg("failed to compile client BPF filter")
+					err := conn.Close()
+					if err != nil {
+						log.Err(err).Msg("failed to close connection")
+					}
+
+					continue
+				}
+				log.Info().Str("remote", remote).Str("filter", expr).Msg("client BPF filter negotiated")
+			}
+		}
+
+		writer, err := newClientWriter(conn, sources)
 		if err != nil {
 			log.Err(err).Msg("failed to write pcap header")
 			err := conn.Close()
@@ -173,49 +517,477 @@ func Main() {
 			continue
 		}
 
-		// add connection to map
-		connMap[conn] = PcapClient{writer: writer}
+		client := &PcapClient{
+			conn:           conn,
+			writer:         writer,
+			bpfs:           bpfs,
+			queue:          make(chan packetEnvelope, *clientBufferPackets),
+			maxBufferBytes: *clientBufferBytes,
+		}
+		clients.add(client)
+		go serveClient(client, clients)
 	}
 
 	log.Info().Msg("PCAP-over-IP server exiting")
+}
+
+// splitInterfaces parses a comma separated -live flag value into interface
+// names, ignoring blanks so "eth0, eth1" and "eth0,eth1" both work.
+func splitInterfaces(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	var ifaces []string
+	for _, iface := range strings.Split(value, ",") {
+		iface = strings.TrimSpace(iface)
+		if iface != "" {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	return ifaces
+}
+
+// startCommandSource runs one -cmd capture command, piping its stdout into a
+// pcap offline handle, same as the original single-command behaviour.
+func startCommandSource(ctx context.Context, cancel context.CancelFunc, commandLine string, index int) (*source, error) {
+	// Create a pipe for the command to write to, will be read by pcap.OpenOfflineFile
+	rStdout, wStdout, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := shlex.Split(commandLine)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	log.Debug().Strs("args", args).Send()
+
+	cmd.Stdout = wStdout
+	cmd.Stderr = log.Logger.Hook(zerolog.HookFunc(func(e *zerolog.Event, level zerolog.Level, msg string) {
+		e.Str(zerolog.LevelFieldName, zerolog.LevelTraceValue)
+	}))
 
-	err = rStdout.Close()
+	err = cmd.Start()
 	if err != nil {
-		log.Err(err).Msg("failed to close read pipe")
+		return nil, err
 	}
 
-	err = wStdout.Close()
+	log.Debug().Int("pid", cmd.Process.Pid).Msg("started process")
+
+	// close context on process exit
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			log.Fatal().Err(err).Msg("command exited with error")
+		}
+		cancel()
+	}()
+
+	// Read from process stdout pipe
+	handle, err := pcap.OpenOfflineFile(rStdout)
 	if err != nil {
-		log.Err(err).Msg("failed to close write pipe")
+		return nil, err
 	}
+
+	return &source{
+		name:        fmt.Sprintf("cmd%d", index),
+		description: commandLine,
+		linkType:    handle.LinkType(),
+		packets:     handle,
+	}, nil
 }
 
+// openLiveSource captures from iface directly via pcap, bypassing the -cmd
+// subprocess and the pipe buffering that comes with it. The handle is built
+// up the same way the OpenLive/SetBPFFilter examples in the gopacket docs do:
+// an InactiveHandle is configured and then Activate()'d.
+func openLiveSource(iface string) (*source, error) {
+	inactive, err := pcap.NewInactiveHandle(iface)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	if err := inactive.SetSnapLen(*liveSnapLen); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetPromisc(*livePromisc); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetImmediateMode(*liveImmediate); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetTimeout(*liveTimeout); err != nil {
+		return nil, err
+	}
+
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, err
+	}
+
+	if *liveBPF != "" {
+		if err := handle.SetBPFFilter(*liveBPF); err != nil {
+			handle.Close()
+			return nil, err
+		}
+	}
+
+	return &source{
+		name:        iface,
+		description: fmt.Sprintf("live capture on %s", iface),
+		linkType:    handle.LinkType(),
+		packets:     handle,
+	}, nil
+}
+
+// buildTLSConfig builds the tls.Config to serve PCAP-over-IP over, or nil if
+// -tls-cert/-tls-key aren't set. When -tls-client-ca is also given, client
+// certificates are required and verified against it (mTLS).
+func buildTLSConfig() (*tls.Config, error) {
+	if *tlsCertFile == "" && *tlsKeyFile == "" {
+		return nil, nil
+	}
+	if *tlsCertFile == "" || *tlsKeyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load -tls-cert/-tls-key: %w", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if *tlsClientCA != "" {
+		caPEM, err := os.ReadFile(*tlsClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read -tls-client-ca: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("failed to parse -tls-client-ca %s", *tlsClientCA)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// printInterfaces implements -list-interfaces: it prints every interface
+// pcap.FindAllDevs finds, along with its description and addresses, and is
+// meant to help pick a value for -live.
+func printInterfaces() {
+	ifaces, err := pcap.FindAllDevs()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to list interfaces")
+	}
+
+	for _, iface := range ifaces {
+		addrs := make([]string, 0, len(iface.Addresses))
+		for _, addr := range iface.Addresses {
+			addrs = append(addrs, addr.IP.String())
+		}
+		log.Info().Str("name", iface.Name).Str("description", iface.Description).Strs("addresses", addrs).Send()
+	}
+}
+
+// feedSource reads packets off a single source and feeds them to the shared
+// fan-out channel, stamping each packet with the source's interface index.
+// ZeroCopyReadPacketData's returned slice is only valid until the next call,
+// so it's copied into a buffer of its own before being handed to out, which
+// is read later and by other goroutines (processPackets, and then each
+// client's own serveClient) while feedSource has already moved on to the
+// next packet.
+func feedSource(ctx context.Context, ifaceID int, src *source, out chan<- packetEnvelope) {
+	for {
+		data, ci, err := src.packets.ZeroCopyReadPacketData()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Err(err).Str("source", src.name).Msg("failed to read packet from source")
+			}
+			return
+		}
+
+		ci.InterfaceIndex = ifaceID
+
+		buf := make([]byte, len(data))
+		copy(buf, data)
+
+		select {
+		case out <- packetEnvelope{ci: ci, data: buf}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newClientWriter builds the packetWriter a newly connected client streams
+// from: a legacy single-link pcapgo.Writer when -legacy-pcap is set, or a
+// pcapng NgWriter with one Interface Description Block per capture source.
+func newClientWriter(conn net.Conn, sources []*source) (packetWriter, error) {
+	if *legacyPcap {
+		writer := pcapgo.NewWriter(conn)
+		if err := writer.WriteFileHeader(65535, sources[0].linkType); err != nil {
+			return nil, err
+		}
+		return writer, nil
+	}
+
+	writer, err := pcapgo.NewNgWriterInterface(conn, ngInterface(sources[0]), pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, src := range sources[1:] {
+		if _, err := writer.AddInterface(ngInterface(src)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+func ngInterface(src *source) pcapgo.NgInterface {
+	return pcapgo.NgInterface{
+		Name:                src.name,
+		Description:         src.description,
+		LinkType:            src.linkType,
+		TimestampResolution: 9,
+		SnapLength:          65535,
+	}
+}
+
+// readClientFilter gives a newly connected client a short window to send a
+// preamble line of the form "FILTER <bpf expression>\n" before the pcap file
+// header is written back, read off r (the connection's shared preamble
+// reader, also used by authenticateToken, so a client pipelining both
+// preambles in one write doesn't have this one swallowed). If the client
+// sends nothing within clientFilterPreamble, the connection is treated as
+// unfiltered and streaming proceeds as before. The expression itself is
+// returned uncompiled: a single connection's packets can come from sources
+// with different link types (a -cmd capture and a -live interface can have
+// different encapsulations), so it must be compiled once per source's own
+// link type by compileClientFilter rather than once against just the first
+// source.
+func readClientFilter(conn net.Conn, r *bufio.Reader) (string, error) {
+	err := conn.SetReadDeadline(time.Now().Add(clientFilterPreamble))
+	if err != nil {
+		return "", err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		// no preamble sent (timeout, EOF, ...): fall back to unfiltered streaming
+		return "", nil
+	}
+
+	line = strings.TrimSpace(line)
+	expr, ok := strings.CutPrefix(line, "FILTER ")
+	if !ok {
+		log.Warn().Str("line", line).Msg("ignoring unrecognized client preamble")
+		return "", nil
+	}
+
+	return expr, nil
+}
+
+// compileClientFilter compiles expr once per source, keyed by that source's
+// position in sources (the same index packetEnvelope.ci.InterfaceIndex
+// carries), since a BPF program compiled for one link type produces wrong
+// results when applied to packets encapsulated with a different one.
+func compileClientFilter(expr string, sources []*source) (map[int]*pcap.BPF, error) {
+	bpfs := make(map[int]*pcap.BPF, len(sources))
+	for i, src := range sources {
+		bpf, err := pcap.NewBPF(src.linkType, 65535, expr)
+		if err != nil {
+			return nil, fmt.Errorf("source %d (%s): %w", i, src.name, err)
+		}
+		bpfs[i] = bpf
+	}
+	return bpfs, nil
+}
+
+// authenticateToken gives a newly connected client a short window to send an
+// "AUTH <token>\n" preamble line when -auth-token-file is configured, before
+// the pcap header (or the FILTER preamble) is written back, read off r (the
+// connection's shared preamble reader, also used by readClientFilter, so a
+// client pipelining both preambles in one write doesn't have the later one
+// swallowed by whichever reader got there first). It returns the matched
+// token's label, or an error if no valid token was presented.
+func authenticateToken(conn net.Conn, r *bufio.Reader, tokens *tokenStore) (string, error) {
+	err := conn.SetReadDeadline(time.Now().Add(clientFilterPreamble))
+	if err != nil {
+		return "", err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("no AUTH preamble received: %w", err)
+	}
+
+	token, ok := strings.CutPrefix(strings.TrimSpace(line), "AUTH ")
+	if !ok {
+		return "", fmt.Errorf("expected AUTH preamble, got %q", strings.TrimSpace(line))
+	}
+
+	label, ok := tokens.authenticate(token)
+	if !ok {
+		return "", errors.New("invalid auth token")
+	}
+
+	return label, nil
+}
+
+// processPackets fans each packet out to every connected client's buffer.
+// It never writes to a connection itself and never blocks on a client: the
+// actual write happens in that client's own serveClient goroutine, so one
+// stalled TCP client can no longer hold up delivery to the rest, or back up
+// the capture pipeline feeding packets.
 func processPackets(
 	ctx context.Context,
-	packetSource *gopacket.PacketSource,
-	connMap map[net.Conn]PcapClient,
+	packets <-chan packetEnvelope,
+	clients *clientRegistry,
 ) {
-	for packet := range packetSource.Packets() {
+	for envelope := range packets {
 		select {
 		case <-ctx.Done():
 			return
 		default:
 		}
 
-		for conn, stats := range connMap {
-			ci := packet.Metadata().CaptureInfo
-			err := stats.writer.WritePacket(ci, packet.Data())
-			if err != nil {
-				log.Err(err).Msg("failed to write packet to connection")
-				delete(connMap, conn)
-				err := conn.Close()
-				if err != nil {
-					log.Err(err).Msg("failed to close connection")
-				}
+		for _, client := range clients.snapshot() {
+			if bpf, ok := client.bpfs[envelope.ci.InterfaceIndex]; ok && !bpf.Matches(envelope.ci, envelope.data) {
 				continue
 			}
-			stats.totalPackets += 1
-			stats.totalBytes += uint64(ci.CaptureLength)
+			client.enqueue(envelope)
+		}
+	}
+}
+
+// serveClient drains one client's buffer and writes packets to its
+// connection, until the queue is closed (by enqueue, under
+// -slow-client-policy=disconnect) or a write fails.
+func serveClient(client *PcapClient, clients *clientRegistry) {
+	defer clients.remove(client.conn)
+	defer client.conn.Close()
+
+	for envelope := range client.queue {
+		atomic.AddInt64(&client.queuedBytes, -int64(len(envelope.data)))
+
+		err := client.writer.WritePacket(envelope.ci, envelope.data)
+		if err == nil {
+			if f, ok := client.writer.(flusher); ok {
+				err = f.Flush()
+			}
+		}
+		if err != nil {
+			log.Err(err).Str("remote", client.conn.RemoteAddr().String()).Msg("failed to write packet to connection")
+			return
+		}
+
+		atomic.AddUint64(&client.totalPackets, 1)
+		atomic.AddUint64(&client.totalBytes, uint64(envelope.ci.CaptureLength))
+	}
+}
+
+// runDialer implements one -connect target: it dials out, registers the
+// connection as an ordinary client so it shares the same fan-out and
+// per-client buffering as inbound connections, and blocks in serveClient
+// until the connection drops. It then reconnects with exponential backoff
+// (-reconnect-backoff, capped at -reconnect-max) until ctx is cancelled.
+func runDialer(ctx context.Context, target string, tlsConfig *tls.Config, sources []*source, clients *clientRegistry) {
+	backoff := *reconnectBackoff
+
+	for {
+		conn, err := dialTarget(ctx, target, tlsConfig)
+		if err != nil {
+			log.Err(err).Str("target", target).Msg("failed to connect to -connect target")
+			if !sleepBackoff(ctx, &backoff) {
+				return
+			}
+			continue
+		}
+
+		log.Info().Str("target", target).Msg("connected to -connect target")
+		backoff = *reconnectBackoff
+
+		writer, err := newClientWriter(conn, sources)
+		if err != nil {
+			log.Err(err).Str("target", target).Msg("failed to write pcap header to -connect target")
+			conn.Close()
+			if !sleepBackoff(ctx, &backoff) {
+				return
+			}
+			continue
+		}
+
+		client := &PcapClient{
+			conn:           conn,
+			writer:         writer,
+			queue:          make(chan packetEnvelope, *clientBufferPackets),
+			maxBufferBytes: *clientBufferBytes,
+		}
+		clients.add(client)
+		serveClient(client, clients)
+
+		log.Warn().Str("target", target).Msg("disconnected from -connect target, reconnecting")
+		if !sleepBackoff(ctx, &backoff) {
+			return
+		}
+	}
+}
+
+// dialTarget dials target, wrapping the connection in TLS when -connect-tls
+// is set (tlsConfig is non-nil).
+func dialTarget(ctx context.Context, target string, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := net.Dialer{}
+	if tlsConfig == nil {
+		return dialer.DialContext(ctx, "tcp", target)
+	}
+
+	tlsDialer := tls.Dialer{NetDialer: &dialer, Config: tlsConfig}
+	return tlsDialer.DialContext(ctx, "tcp", target)
+}
+
+// sleepBackoff waits out the current backoff (or ctx being cancelled),
+// whichever comes first, then doubles backoff for the next call up to
+// -reconnect-max. It reports whether the caller should retry.
+func sleepBackoff(ctx context.Context, backoff *time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(*backoff):
+	}
+
+	*backoff *= 2
+	if *backoff > *reconnectMax {
+		*backoff = *reconnectMax
+	}
+	return true
+}
+
+// metricsHandler renders per-client packet/byte/drop counters for
+// -metrics-listen in Prometheus text exposition format.
+func metricsHandler(clients *clientRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		for _, client := range clients.snapshot() {
+			remote := client.conn.RemoteAddr().String()
+			fmt.Fprintf(w, "pcap_broker_client_packets_total{remote=%q} %d\n", remote, atomic.LoadUint64(&client.totalPackets))
+			fmt.Fprintf(w, "pcap_broker_client_bytes_total{remote=%q} %d\n", remote, atomic.LoadUint64(&client.totalBytes))
+			fmt.Fprintf(w, "pcap_broker_client_dropped_packets_total{remote=%q} %d\n", remote, atomic.LoadUint64(&client.droppedPackets))
 		}
 	}
 }
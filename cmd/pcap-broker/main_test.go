@@ -0,0 +1,712 @@
+package pcap_broker
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// fakeConn wraps a net.Pipe() end so it satisfies net.Conn for readClientFilter
+// and records everything written to it by processPackets.
+func newFakeConn(t *testing.T) (client net.Conn, broker net.Conn) {
+	t.Helper()
+	client, broker = net.Pipe()
+	return client, broker
+}
+
+func openGoldenSource(t *testing.T) *source {
+	t.Helper()
+
+	f, err := os.Open("testdata/golden.pcap")
+	if err != nil {
+		t.Fatalf("failed to open golden pcap: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatalf("failed to open pcap reader: %v", err)
+	}
+
+	return &source{
+		name:     "golden",
+		linkType: r.LinkType(),
+		packets:  r,
+	}
+}
+
+// feedEnvelopes drains src through feedSource into a channel the test can
+// range over, closing it once the golden pcap is exhausted.
+func feedEnvelopes(ctx context.Context, src *source) <-chan packetEnvelope {
+	out := make(chan packetEnvelope, 16)
+	go func() {
+		feedSource(ctx, 0, src, out)
+		close(out)
+	}()
+	return out
+}
+
+// reusedBufferSource is a gopacket.ZeroCopyPacketDataSource that hands back
+// the same backing array on every call, overwritten in place, the way
+// pcap.Handle and pcapgo.Reader's ZeroCopyReadPacketData both do. It lets
+// tests catch code that holds onto a returned slice past the next read.
+type reusedBufferSource struct {
+	packets [][]byte
+	buf     []byte
+	i       int
+}
+
+func (s *reusedBufferSource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if s.i >= len(s.packets) {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+
+	p := s.packets[s.i]
+	s.i++
+
+	s.buf = append(s.buf[:0], p...)
+	return s.buf, gopacket.CaptureInfo{CaptureLength: len(p), Length: len(p)}, nil
+}
+
+// TestFeedSourceCopiesZeroCopyData checks that feedSource copies the packet
+// data ZeroCopyReadPacketData returns before queuing it, rather than handing
+// out a slice that the source's next read is free to overwrite underneath a
+// consumer still holding it.
+func TestFeedSourceCopiesZeroCopyData(t *testing.T) {
+	src := &source{
+		name:    "reused",
+		packets: &reusedBufferSource{packets: [][]byte{[]byte("first packet"), []byte("second packet")}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var envelopes []packetEnvelope
+	for env := range feedEnvelopes(ctx, src) {
+		envelopes = append(envelopes, env)
+	}
+
+	if len(envelopes) != 2 {
+		t.Fatalf("expected 2 packets, got %d", len(envelopes))
+	}
+	if got := string(envelopes[0].data); got != "first packet" {
+		t.Errorf("expected first queued packet to still read %q, got %q (overwritten by the source's later read)", "first packet", got)
+	}
+	if got := string(envelopes[1].data); got != "second packet" {
+		t.Errorf("expected second queued packet to read %q, got %q", "second packet", got)
+	}
+}
+
+func TestReadClientFilter(t *testing.T) {
+	client, broker := newFakeConn(t)
+	defer client.Close()
+	defer broker.Close()
+
+	go func() {
+		w := bufio.NewWriter(client)
+		w.WriteString("FILTER host 10.0.0.1\n")
+		w.Flush()
+	}()
+
+	expr, err := readClientFilter(broker, bufio.NewReader(broker))
+	if err != nil {
+		t.Fatalf("readClientFilter returned error: %v", err)
+	}
+	if expr != "host 10.0.0.1" {
+		t.Fatalf("expected filter expression %q, got %q", "host 10.0.0.1", expr)
+	}
+}
+
+func TestReadClientFilterNoPreamble(t *testing.T) {
+	client, broker := newFakeConn(t)
+	defer client.Close()
+	defer broker.Close()
+
+	expr, err := readClientFilter(broker, bufio.NewReader(broker))
+	if err != nil {
+		t.Fatalf("readClientFilter returned error: %v", err)
+	}
+	if expr != "" {
+		t.Fatalf("expected no filter expression when client sends nothing, got %q", expr)
+	}
+}
+
+// TestProcessPacketsPerClientFilter feeds the golden pcap through processPackets
+// with two clients holding mismatched filters, and asserts each client only
+// receives the packets its own filter matches.
+func TestProcessPacketsPerClientFilter(t *testing.T) {
+	matchAll, err := pcap.NewBPF(layers.LinkTypeEthernet, 65535, "udp")
+	if err != nil {
+		t.Fatalf("failed to compile filter: %v", err)
+	}
+	matchPort80, err := pcap.NewBPF(layers.LinkTypeEthernet, 65535, "port 80")
+	if err != nil {
+		t.Fatalf("failed to compile filter: %v", err)
+	}
+
+	allClient, allBroker := newFakeConn(t)
+	defer allClient.Close()
+	defer allBroker.Close()
+
+	port80Client, port80Broker := newFakeConn(t)
+	defer port80Client.Close()
+	defer port80Broker.Close()
+
+	allWriter := pcapgo.NewWriter(allBroker)
+	port80Writer := pcapgo.NewWriter(port80Broker)
+
+	allCount := make(chan int, 1)
+	port80Count := make(chan int, 1)
+	go countPackets(allClient, allCount)
+	go countPackets(port80Client, port80Count)
+
+	if err := allWriter.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("failed to write pcap header: %v", err)
+	}
+	if err := port80Writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("failed to write pcap header: %v", err)
+	}
+
+	clients := newClientRegistry()
+	allPcapClient := &PcapClient{
+		conn:           allBroker,
+		writer:         allWriter,
+		bpfs:           map[int]*pcap.BPF{0: matchAll},
+		queue:          make(chan packetEnvelope, 16),
+		maxBufferBytes: 1 << 20,
+	}
+	port80PcapClient := &PcapClient{
+		conn:           port80Broker,
+		writer:         port80Writer,
+		bpfs:           map[int]*pcap.BPF{0: matchPort80},
+		queue:          make(chan packetEnvelope, 16),
+		maxBufferBytes: 1 << 20,
+	}
+	clients.add(allPcapClient)
+	clients.add(port80PcapClient)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go serveClient(allPcapClient, clients)
+	go serveClient(port80PcapClient, clients)
+
+	packets := feedEnvelopes(ctx, openGoldenSource(t))
+	processPackets(ctx, packets, clients)
+	close(allPcapClient.queue)
+	close(port80PcapClient.queue)
+
+	allClient.Close()
+	port80Client.Close()
+
+	if got := <-allCount; got != 3 {
+		t.Errorf("expected 3 packets for unfiltered udp client, got %d", got)
+	}
+	if got := <-port80Count; got != 1 {
+		t.Errorf("expected 1 packet for port-80 client, got %d", got)
+	}
+}
+
+// buildUDPPacket serializes a minimal IPv4/UDP packet carrying dstPort, with
+// or without an Ethernet header, for tests that need sources with different
+// link types without a pcap file on disk.
+func buildUDPPacket(t *testing.T, withEthernet bool, dstPort uint16) []byte {
+	t.Helper()
+
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: layers.UDPPort(dstPort)}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatalf("failed to set network layer for checksum: %v", err)
+	}
+
+	var toSerialize []gopacket.SerializableLayer
+	if withEthernet {
+		toSerialize = append(toSerialize, &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x00, 0x01, 0x02, 0x03, 0x04, 0x05},
+			DstMAC:       net.HardwareAddr{0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b},
+			EthernetType: layers.EthernetTypeIPv4,
+		})
+	}
+	toSerialize = append(toSerialize, ip, udp, gopacket.Payload([]byte("hi")))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, toSerialize...); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+
+	data := make([]byte, len(buf.Bytes()))
+	copy(data, buf.Bytes())
+	return data
+}
+
+// countNgPackets reads a pcapng stream written across possibly several
+// Interface Description Blocks and reports how many packets it carried.
+func countNgPackets(conn net.Conn, result chan<- int) {
+	r, err := pcapgo.NewNgReader(conn, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		result <- 0
+		return
+	}
+
+	count := 0
+	for {
+		if _, _, err := r.ZeroCopyReadPacketData(); err != nil {
+			break
+		}
+		count++
+	}
+	result <- count
+}
+
+// TestProcessPacketsPerSourceFilterMultiLinkType checks that a client's single
+// negotiated filter expression is compiled once per source against that
+// source's own link type, rather than once against just the first source, so
+// it still matches correctly when sources have different encapsulations (one
+// -cmd capture and one -live interface, say). It also exercises the pcapng
+// NgWriter path with multiple Interface Description Blocks, which no earlier
+// test did.
+func TestProcessPacketsPerSourceFilterMultiLinkType(t *testing.T) {
+	ethSrc := &source{name: "eth0", linkType: layers.LinkTypeEthernet}
+	rawSrc := &source{name: "raw0", linkType: layers.LinkTypeRaw}
+	sources := []*source{ethSrc, rawSrc}
+
+	bpfs, err := compileClientFilter("port 80", sources)
+	if err != nil {
+		t.Fatalf("failed to compile per-source filter: %v", err)
+	}
+
+	clientConn, broker := newFakeConn(t)
+	defer clientConn.Close()
+	defer broker.Close()
+
+	writer, err := pcapgo.NewNgWriterInterface(broker, ngInterface(ethSrc), pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		t.Fatalf("failed to create ng writer: %v", err)
+	}
+	if _, err := writer.AddInterface(ngInterface(rawSrc)); err != nil {
+		t.Fatalf("failed to add second interface: %v", err)
+	}
+
+	client := &PcapClient{
+		conn:           broker,
+		writer:         writer,
+		bpfs:           bpfs,
+		queue:          make(chan packetEnvelope, 16),
+		maxBufferBytes: 1 << 20,
+	}
+	clients := newClientRegistry()
+	clients.add(client)
+
+	count := make(chan int, 1)
+	go countNgPackets(clientConn, count)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveClient(client, clients)
+
+	ethData := buildUDPPacket(t, true, 80)
+	rawData := buildUDPPacket(t, false, 80)
+
+	packets := make(chan packetEnvelope, 2)
+	packets <- packetEnvelope{ci: gopacket.CaptureInfo{CaptureLength: len(ethData), Length: len(ethData), InterfaceIndex: 0}, data: ethData}
+	packets <- packetEnvelope{ci: gopacket.CaptureInfo{CaptureLength: len(rawData), Length: len(rawData), InterfaceIndex: 1}, data: rawData}
+	close(packets)
+
+	processPackets(ctx, packets, clients)
+	close(client.queue)
+	clientConn.Close()
+
+	if got := <-count; got != 2 {
+		t.Errorf("expected both sources' port-80 packets to match their own link type's filter, got %d", got)
+	}
+}
+
+// TestPcapClientEnqueueDropOldest checks that a client stuck at its packet
+// bound drops its oldest queued packet to make room for the newest one,
+// rather than blocking or growing without bound.
+func TestPcapClientEnqueueDropOldest(t *testing.T) {
+	old := *slowClientPolicy
+	*slowClientPolicy = slowClientPolicyDropOldest
+	defer func() { *slowClientPolicy = old }()
+
+	_, broker := newFakeConn(t)
+	defer broker.Close()
+
+	client := &PcapClient{
+		conn:           broker,
+		queue:          make(chan packetEnvelope, 2),
+		maxBufferBytes: 1 << 20,
+	}
+
+	client.enqueue(packetEnvelope{data: []byte("first")})
+	client.enqueue(packetEnvelope{data: []byte("second")})
+	client.enqueue(packetEnvelope{data: []byte("third")})
+
+	if got := len(client.queue); got != 2 {
+		t.Fatalf("expected queue to stay bounded at 2, got %d", got)
+	}
+	if dropped := atomic.LoadUint64(&client.droppedPackets); dropped != 1 {
+		t.Fatalf("expected 1 dropped packet, got %d", dropped)
+	}
+
+	first := <-client.queue
+	if string(first.data) != "second" {
+		t.Fatalf("expected oldest packet to have been dropped, queue head was %q", first.data)
+	}
+}
+
+// TestProcessPacketsPreservesDataForSlowClient feeds a source that reuses its
+// read buffer (the way pcap.Handle and pcapgo.Reader both do) all the way
+// through feedSource, processPackets and a client's bounded queue, without
+// starting that client's serveClient goroutine until every packet has
+// already been read off the source and queued. That's exactly what a client
+// stuck behind a slow TCP peer looks like, and it would reliably corrupt
+// queued packets if anything along the path still held onto the source's
+// buffer instead of its own copy.
+func TestProcessPacketsPreservesDataForSlowClient(t *testing.T) {
+	const n = 50
+	want := make([][]byte, n)
+	packets := make([][]byte, n)
+	for i := range packets {
+		want[i] = []byte(fmt.Sprintf("packet-%03d", i))
+		packets[i] = append([]byte(nil), want[i]...)
+	}
+	src := &source{name: "reused", packets: &reusedBufferSource{packets: packets}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientConn, broker := newFakeConn(t)
+	defer clientConn.Close()
+	defer broker.Close()
+
+	writer := pcapgo.NewWriter(broker)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("failed to write pcap header: %v", err)
+	}
+
+	client := &PcapClient{
+		conn:           broker,
+		writer:         writer,
+		queue:          make(chan packetEnvelope, n),
+		maxBufferBytes: 1 << 20,
+	}
+	clients := newClientRegistry()
+	clients.add(client)
+
+	processPackets(ctx, feedEnvelopes(ctx, src), clients)
+	close(client.queue)
+
+	got := make(chan [][]byte, 1)
+	go func() {
+		r, err := pcapgo.NewReader(clientConn)
+		if err != nil {
+			got <- nil
+			return
+		}
+
+		var payloads [][]byte
+		for {
+			data, _, err := r.ReadPacketData()
+			if err != nil {
+				break
+			}
+			payloads = append(payloads, append([]byte(nil), data...))
+		}
+		got <- payloads
+	}()
+
+	serveClient(client, clients)
+	clientConn.Close()
+
+	payloads := <-got
+	if len(payloads) != n {
+		t.Fatalf("expected %d packets delivered to the client, got %d", n, len(payloads))
+	}
+	for i := range want {
+		if string(payloads[i]) != string(want[i]) {
+			t.Errorf("packet %d: expected %q, got %q", i, want[i], payloads[i])
+		}
+	}
+}
+
+// generateSelfSignedCert creates an in-memory self-signed TLS certificate
+// valid for "localhost", for tests that need a real TLS listener.
+func generateSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	cert, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	)
+	if err != nil {
+		t.Fatalf("failed to build TLS certificate: %v", err)
+	}
+	return cert
+}
+
+// TestTLSAndTokenAuth dials a real TLS listener, pipelines an AUTH preamble
+// checked against a token file together with a FILTER preamble in a single
+// write, and confirms the client then reads back only the matching packets
+// of the golden pcap over the encrypted connection. Sending both lines in
+// one write is what catches a server that gives AUTH and FILTER their own
+// bufio.Reader each: the first reader can slurp both lines off the socket in
+// one syscall and silently drop whichever one it wasn't looking for.
+func TestTLSAndTokenAuth(t *testing.T) {
+	serverCert := generateSelfSignedCert(t)
+	leaf, err := x509.ParseCertificate(serverCert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse generated certificate: %v", err)
+	}
+	certPool := x509.NewCertPool()
+	certPool.AddCert(leaf)
+
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokenFile, []byte("s3cret agent-1\n"), 0o600); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+	tokens := newTokenStore()
+	if err := tokens.load(tokenFile); err != nil {
+		t.Fatalf("failed to load token file: %v", err)
+	}
+
+	var envelopes []packetEnvelope
+	for env := range feedEnvelopes(context.Background(), openGoldenSource(t)) {
+		envelopes = append(envelopes, env)
+	}
+	filterSrc := openGoldenSource(t)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	serverErr := make(chan error, 1)
+	serverLabel := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok {
+			serverErr <- errors.New("accepted connection is not TLS")
+			return
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			serverErr <- err
+			return
+		}
+
+		connReader := bufio.NewReader(conn)
+
+		label, err := authenticateToken(conn, connReader, tokens)
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		serverLabel <- label
+
+		expr, err := readClientFilter(conn, connReader)
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		var bpf *pcap.BPF
+		if expr != "" {
+			bpfs, err := compileClientFilter(expr, []*source{filterSrc})
+			if err != nil {
+				serverErr <- err
+				return
+			}
+			bpf = bpfs[0]
+		}
+
+		writer := pcapgo.NewWriter(conn)
+		if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+			serverErr <- err
+			return
+		}
+		for _, env := range envelopes {
+			if bpf != nil && !bpf.Matches(env.ci, env.data) {
+				continue
+			}
+			if err := writer.WritePacket(env.ci, env.data); err != nil {
+				serverErr <- err
+				return
+			}
+		}
+		serverErr <- nil
+	}()
+
+	clientConn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: certPool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("failed to dial TLS: %v", err)
+	}
+	defer clientConn.Close()
+
+	if _, err := clientConn.Write([]byte("AUTH s3cret\nFILTER port 80\n")); err != nil {
+		t.Fatalf("failed to send AUTH+FILTER preamble: %v", err)
+	}
+
+	r, err := pcapgo.NewReader(clientConn)
+	if err != nil {
+		t.Fatalf("failed to read pcap header: %v", err)
+	}
+
+	count := 0
+	for {
+		if _, _, err := r.ReadPacketData(); err != nil {
+			break
+		}
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expected the pipelined FILTER preamble to be honored (1 port-80 packet), got %d", count)
+	}
+
+	if label := <-serverLabel; label != "agent-1" {
+		t.Errorf("expected token label %q, got %q", "agent-1", label)
+	}
+	if err := <-serverErr; err != nil {
+		t.Errorf("server goroutine error: %v", err)
+	}
+}
+
+// TestAuthenticateTokenRejectsBadToken checks that a wrong or missing token
+// is rejected rather than silently falling back to unauthenticated access,
+// unlike the optional FILTER preamble.
+func TestAuthenticateTokenRejectsBadToken(t *testing.T) {
+	tokens := newTokenStore()
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokenFile, []byte("s3cret agent-1\n"), 0o600); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+	if err := tokens.load(tokenFile); err != nil {
+		t.Fatalf("failed to load token file: %v", err)
+	}
+
+	client, broker := newFakeConn(t)
+	defer client.Close()
+	defer broker.Close()
+
+	go func() {
+		w := bufio.NewWriter(client)
+		w.WriteString("AUTH wrong-token\n")
+		w.Flush()
+	}()
+
+	if _, err := authenticateToken(broker, bufio.NewReader(broker), tokens); err == nil {
+		t.Fatal("expected an error for an invalid token, got nil")
+	}
+}
+
+// TestRunDialerReconnects checks that a -connect target which drops its
+// connection gets dialed again, rather than runDialer giving up.
+func TestRunDialerReconnects(t *testing.T) {
+	oldBackoff, oldMax := *reconnectBackoff, *reconnectMax
+	*reconnectBackoff, *reconnectMax = time.Millisecond, 10*time.Millisecond
+	defer func() { *reconnectBackoff, *reconnectMax = oldBackoff, oldMax }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	clients := newClientRegistry()
+	sources := []*source{openGoldenSource(t)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go runDialer(ctx, l.Addr().String(), nil, sources, clients)
+
+	firstConn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept first dial attempt: %v", err)
+	}
+	if _, err := pcapgo.NewReader(firstConn); err != nil {
+		t.Fatalf("failed to read pcap header from first attempt: %v", err)
+	}
+	firstConn.Close()
+
+	secondConn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("runDialer did not reconnect after disconnect: %v", err)
+	}
+	defer secondConn.Close()
+
+	if _, err := pcapgo.NewReader(secondConn); err != nil {
+		t.Fatalf("failed to read pcap header from reconnect attempt: %v", err)
+	}
+}
+
+func countPackets(conn net.Conn, result chan<- int) {
+	r, err := pcapgo.NewReader(conn)
+	if err != nil {
+		result <- 0
+		return
+	}
+
+	count := 0
+	for {
+		_, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		count++
+	}
+	result <- count
+}